@@ -6,6 +6,10 @@ package main
 
 import (
 	"archive/zip"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/xml"
+	"flag"
 	"fmt"
 	"go/build"
 	"io"
@@ -15,18 +19,309 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"golang.org/x/mobile/bind"
 )
 
+var (
+	// Maven publish flags, used by buildMaven when -publish is set.
+	bindPublish  bool
+	bindGroup    string
+	bindArtifact string
+	bindVersion  string
+	bindDeps     mavenDeps
+
+	// AndroidManifest.xml merge flags, used by buildManifest.
+	bindMinSDK    int
+	bindTargetSDK int
+	bindManifest  string
+
+	// Proguard/R8 rule collection flag, used by buildProguard.
+	bindNoProguard bool
+
+	// Prefab native header flag, used by buildPrefab.
+	bindHeaders libHeaderDirs
+
+	// Per-ABI build flags, used by filterAndroidArchs and stripSO.
+	bindABIFilter string
+	bindNoStrip   bool
+)
+
+func init() {
+	flag.BoolVar(&bindPublish, "publish", false, "also lay out a Maven repository tree (groupId/artifactId/version) containing the AAR, sources jar and a generated POM, next to the AAR")
+	flag.StringVar(&bindGroup, "group", "", "Maven groupId to publish under; required with -publish")
+	flag.StringVar(&bindArtifact, "artifact", "", "Maven artifactId to publish under; defaults to the bound package name")
+	flag.StringVar(&bindVersion, "version", "", "Maven version to publish under; required with -publish")
+	flag.Var(&bindDeps, "dep", "Android dependency groupId:artifactId:version needed by the bound package at runtime; may be repeated")
+	flag.IntVar(&bindMinSDK, "minsdk", 0, "minimum Android SDK version to require; defaults to 15, or higher if a merged AndroidManifest.xml fragment requires it")
+	flag.IntVar(&bindTargetSDK, "targetsdk", 0, "target Android SDK version to declare; omitted unless set here or by a merged AndroidManifest.xml fragment")
+	flag.StringVar(&bindManifest, "manifest", "", "path to an AndroidManifest.xml fragment to merge into the generated manifest, in addition to any found in bound packages")
+	flag.BoolVar(&bindNoProguard, "noproguard", false, "don't collect per-package proguard-rules.pro/consumer-rules.pro or auto-generate keep rules for bound Java classes; ship only the default keep rule")
+	flag.Var(&bindHeaders, "headers", "lib=dir: copy dir into the include/ directory of the named native lib's Prefab module; may be repeated")
+	flag.StringVar(&bindABIFilter, "abi-filter", "", "comma-separated list of Android ABIs to build for, overriding the default set; combined with any exclude: true ABIs in gomobile.yaml")
+	flag.BoolVar(&bindNoStrip, "nostrip", false, "don't strip unneeded symbols from built .so files with llvm-strip")
+}
+
+// libHeaderDir is one entry recorded by a repeatable -headers flag.
+type libHeaderDir struct {
+	Lib, Dir string
+}
+
+// libHeaderDirs implements flag.Value to collect repeated -headers flags.
+type libHeaderDirs []libHeaderDir
+
+func (h *libHeaderDirs) String() string {
+	var parts []string
+	for _, e := range *h {
+		parts = append(parts, e.Lib+"="+e.Dir)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (h *libHeaderDirs) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid -headers %q, want lib=dir", s)
+	}
+	*h = append(*h, libHeaderDir{Lib: parts[0], Dir: parts[1]})
+	return nil
+}
+
+// mavenDep is one entry recorded by a repeatable -dep flag.
+type mavenDep struct {
+	Group, Artifact, Version string
+}
+
+// mavenDeps implements flag.Value to collect repeated -dep flags.
+type mavenDeps []mavenDep
+
+func (d *mavenDeps) String() string {
+	var parts []string
+	for _, dep := range *d {
+		parts = append(parts, fmt.Sprintf("%s:%s:%s", dep.Group, dep.Artifact, dep.Version))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *mavenDeps) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid -dep %q, want groupId:artifactId:version", s)
+	}
+	*d = append(*d, mavenDep{Group: parts[0], Artifact: parts[1], Version: parts[2]})
+	return nil
+}
+
+// gomobileConfigFile is the name of the optional per-ABI config file, read from the
+// main package directory.
+const gomobileConfigFile = "gomobile.yaml"
+
+// abiOverride is one ABI's entry under the "abis" key of gomobile.yaml.
+type abiOverride struct {
+	Exclude       bool
+	LDFlags       string
+	ExcludeAssets []string
+}
+
+// gomobileConfig is the schema of gomobile.yaml: per-ABI overrides for ABI
+// inclusion/exclusion, extra -ldflags, and assets to leave out of the AAR.
+type gomobileConfig struct {
+	ABIs map[string]abiOverride
+}
+
+// loadGomobileConfig reads gomobile.yaml from dir. It returns a nil config and nil
+// error if the file does not exist.
+func loadGomobileConfig(dir string) (*gomobileConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, gomobileConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cfg, err := parseGomobileConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gomobileConfigFile, err)
+	}
+	return cfg, nil
+}
+
+// parseGomobileConfig parses the small subset of YAML gomobile.yaml needs:
+//
+//	abis:
+//	  <abi>:
+//	    exclude: true|false
+//	    ldflags: <extra -ldflags value>
+//	    excludeAssets:
+//	      - <asset path, relative to assets/>
+//
+// It is hand-rolled against a fixed two-space indent rather than pulling in a YAML
+// library.
+func parseGomobileConfig(data string) (*gomobileConfig, error) {
+	cfg := &gomobileConfig{ABIs: map[string]abiOverride{}}
+	var abi string
+	var override abiOverride
+	inAssets := false
+
+	flush := func() {
+		if abi != "" {
+			cfg.ABIs[abi] = override
+		}
+	}
+
+	for i, raw := range strings.Split(data, "\n") {
+		line := strings.TrimRight(raw, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		switch {
+		case indent == 0:
+			if trimmed != "abis:" {
+				return nil, fmt.Errorf("line %d: expected top-level \"abis:\" key, got %q", i+1, trimmed)
+			}
+		case indent == 2:
+			flush()
+			abi = strings.TrimSuffix(trimmed, ":")
+			override = abiOverride{}
+			inAssets = false
+		case indent == 4:
+			inAssets = false
+			key, val, err := splitConfigKV(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			switch key {
+			case "exclude":
+				switch val {
+				case "true":
+					override.Exclude = true
+				case "false":
+					override.Exclude = false
+				default:
+					return nil, fmt.Errorf("line %d: exclude must be \"true\" or \"false\", got %q", i+1, val)
+				}
+			case "ldflags":
+				override.LDFlags = val
+			case "excludeAssets":
+				inAssets = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown key %q", i+1, key)
+			}
+		case indent == 6 && inAssets:
+			if !strings.HasPrefix(trimmed, "- ") {
+				return nil, fmt.Errorf("line %d: expected a \"- \" list entry, got %q", i+1, trimmed)
+			}
+			override.ExcludeAssets = append(override.ExcludeAssets, strings.TrimPrefix(trimmed, "- "))
+		default:
+			return nil, fmt.Errorf("line %d: unexpected indentation", i+1)
+		}
+	}
+	flush()
+	return cfg, nil
+}
+
+// splitConfigKV splits a "key: value" line from gomobile.yaml.
+func splitConfigKV(s string) (key, val string, err error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("expected \"key: value\", got %q", s)
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), nil
+}
+
+// filterAndroidArchs intersects archs with -abi-filter (if set) and drops any ABI
+// marked exclude: true in cfg, instead of relying on the caller to pre-filter archs.
+// It also rejects any gomobile.yaml "abis:" key that doesn't match an ABI actually
+// reachable from archs, so a typo like "armeabi-v7" (missing the trailing "a") is
+// reported instead of silently matching nothing.
+func filterAndroidArchs(archs []string, cfg *gomobileConfig) ([]string, error) {
+	var allow map[string]bool
+	if bindABIFilter != "" {
+		allow = map[string]bool{}
+		for _, abi := range strings.Split(bindABIFilter, ",") {
+			allow[strings.TrimSpace(abi)] = true
+		}
+	}
+
+	if cfg != nil {
+		known := map[string]bool{}
+		for _, arch := range archs {
+			known[ndk.Toolchain(arch).abi] = true
+		}
+		for abi := range cfg.ABIs {
+			if !known[abi] {
+				return nil, fmt.Errorf("gomobile.yaml: unknown ABI %q", abi)
+			}
+		}
+	}
+
+	var out []string
+	for _, arch := range archs {
+		abi := ndk.Toolchain(arch).abi
+		if allow != nil && !allow[abi] {
+			continue
+		}
+		if cfg != nil && cfg.ABIs[abi].Exclude {
+			continue
+		}
+		out = append(out, arch)
+	}
+	return out, nil
+}
+
+// excludedAssetNames collects the excludeAssets entries of every ABI that
+// filterAndroidArchs dropped, since assets tied to an excluded ABI (e.g. its debug
+// data) have no reason to ship in an AAR that no longer builds for it.
+func excludedAssetNames(allArchs, keptArchs []string, cfg *gomobileConfig) map[string]bool {
+	excluded := map[string]bool{}
+	if cfg == nil {
+		return excluded
+	}
+	kept := map[string]bool{}
+	for _, arch := range keptArchs {
+		kept[ndk.Toolchain(arch).abi] = true
+	}
+	for _, arch := range allArchs {
+		abi := ndk.Toolchain(arch).abi
+		if kept[abi] {
+			continue
+		}
+		for _, name := range cfg.ABIs[abi].ExcludeAssets {
+			excluded[name] = true
+		}
+	}
+	return excluded
+}
+
 func goAndroidBind(pkgs []*build.Package, androidArchs []string) error {
 	if sdkDir := os.Getenv("ANDROID_HOME"); sdkDir == "" {
 		return fmt.Errorf("this command requires ANDROID_HOME environment variable (path to the Android SDK)")
 	}
+	if bindPublish && (bindGroup == "" || bindVersion == "") {
+		return fmt.Errorf("-group and -version are required with -publish")
+	}
 	// Ideally this would be -buildmode=c-shared.
 	// https://golang.org/issue/13234.
 	androidArgs := []string{"-gcflags=-shared", "-ldflags=-shared"}
 
+	gomobileCfg, err := loadGomobileConfig(cwd)
+	if err != nil {
+		return err
+	}
+	allAndroidArchs := androidArchs
+	androidArchs, err = filterAndroidArchs(androidArchs, gomobileCfg)
+	if err != nil {
+		return err
+	}
+	if len(androidArchs) == 0 {
+		return fmt.Errorf("no Android ABIs left to build after applying -abi-filter/%s", gomobileConfigFile)
+	}
+	excludeAssets := excludedAssetNames(allAndroidArchs, androidArchs, gomobileCfg)
+
 	paths := make([]string, len(pkgs))
 	for i, p := range pkgs {
 		paths[i] = p.ImportPath
@@ -114,20 +409,30 @@ func goAndroidBind(pkgs []*build.Package, androidArchs []string) error {
 		env := envFunc(arch)
 		toolchain := ndk.Toolchain(arch)
 
-		if err := goInstall(paths, env, androidArgs...); err != nil {
+		archArgs := androidArgs
+		if gomobileCfg != nil {
+			if ldflags := gomobileCfg.ABIs[toolchain.abi].LDFlags; ldflags != "" {
+				archArgs = []string{"-gcflags=-shared", "-ldflags=-shared " + ldflags}
+			}
+		}
+
+		if err := goInstall(paths, env, archArgs...); err != nil {
 			return err
 		}
 
 		jniDir := filepath.Join(androidDir, "src/main/jniLibs", toolchain.abi)
+		soPath := filepath.Join(jniDir, "libgojni.so")
 		err = goBuild(
 			mainFile,
 			env,
-			"-buildmode=c-shared",
-			"-o="+filepath.Join(jniDir, "libgojni.so"),
+			append(archArgs, "-buildmode=c-shared", "-o="+soPath)...,
 		)
 		if err != nil {
 			return err
 		}
+		if err := stripSO(soPath); err != nil {
+			return err
+		}
 		dir := libDir(arch)
 		for _, lib := range nativeMeta.Libs {
 			libPath := fmt.Sprintf("lib%s.so", lib)
@@ -136,7 +441,8 @@ func goAndroidBind(pkgs []*build.Package, androidArchs []string) error {
 				return err
 			}
 			defer r.Close()
-			w, err := os.Create(filepath.Join(jniDir, libPath))
+			dstPath := filepath.Join(jniDir, libPath)
+			w, err := os.Create(dstPath)
 			if err != nil {
 				return err
 			}
@@ -144,6 +450,9 @@ func goAndroidBind(pkgs []*build.Package, androidArchs []string) error {
 			if _, err := io.Copy(w, r); err != nil {
 				return err
 			}
+			if err := stripSO(dstPath); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -169,10 +478,16 @@ func goAndroidBind(pkgs []*build.Package, androidArchs []string) error {
 		return err
 	}
 
-	if err := buildAAR(androidDir, pkgs, androidArchs); err != nil {
+	if err := buildAAR(androidDir, pkgs, androidArchs, nativeMeta, excludeAssets); err != nil {
 		return err
 	}
-	return buildSrcJar(androidDir)
+	if err := buildSrcJar(androidDir); err != nil {
+		return err
+	}
+	if bindPublish {
+		return buildMaven(pkgs)
+	}
+	return nil
 }
 
 var androidMainFile = []byte(`
@@ -206,6 +521,117 @@ func buildSrcJar(androidDir string) error {
 	return writeJar(out, src)
 }
 
+// buildMaven lays out the AAR, sources jar and a generated POM under a Maven-style
+// directory tree (groupId/artifactId/version/...) alongside the AAR, plus an .md5 and
+// .sha1 checksum for each artifact, so the tree can be deployed with
+// `mvn deploy:deploy-file` or copied straight into a local/remote Maven repository.
+// buildMaven assumes -group and -version have already been validated by goAndroidBind.
+func buildMaven(pkgs []*build.Package) error {
+	artifact := bindArtifact
+	if artifact == "" {
+		artifact = pkgs[0].Name
+	}
+
+	dir := filepath.Join(strings.Split(bindGroup, ".")...)
+	dir = filepath.Join(filepath.Dir(buildO), dir, artifact, bindVersion)
+	if !buildN {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	ext := filepath.Ext(buildO)
+	srcJar := buildO[:len(buildO)-len(ext)] + "-sources.jar"
+
+	base := fmt.Sprintf("%s-%s", artifact, bindVersion)
+	if err := copyWithChecksums(buildO, filepath.Join(dir, base+".aar")); err != nil {
+		return err
+	}
+	if err := copyWithChecksums(srcJar, filepath.Join(dir, base+"-sources.jar")); err != nil {
+		return err
+	}
+
+	pomPath := filepath.Join(dir, base+".pom")
+	if buildN {
+		return nil
+	}
+	f, err := os.Create(pomPath)
+	if err != nil {
+		return err
+	}
+	err = pomTmpl.Execute(f, struct {
+		Group, Artifact, Version string
+		Deps                     mavenDeps
+	}{bindGroup, artifact, bindVersion, bindDeps})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return writeChecksums(pomPath)
+}
+
+var pomTmpl = template.Must(template.New("pom").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<project xmlns="http://maven.apache.org/POM/4.0.0">
+  <modelVersion>4.0.0</modelVersion>
+  <groupId>{{.Group}}</groupId>
+  <artifactId>{{.Artifact}}</artifactId>
+  <version>{{.Version}}</version>
+  <packaging>aar</packaging>
+{{- if .Deps}}
+  <dependencies>
+{{- range .Deps}}
+    <dependency>
+      <groupId>{{.Group}}</groupId>
+      <artifactId>{{.Artifact}}</artifactId>
+      <version>{{.Version}}</version>
+      <type>aar</type>
+    </dependency>
+{{- end}}
+  </dependencies>
+{{- end}}
+</project>
+`))
+
+// copyWithChecksums copies src to dst and writes dst.md5 and dst.sha1 beside it.
+func copyWithChecksums(src, dst string) (err error) {
+	if buildN {
+		return nil
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return writeChecksums(dst)
+}
+
+// writeChecksums writes path.md5 and path.sha1 files containing the hex digests of path,
+// in the format Maven repositories expect alongside each deployed artifact.
+func writeChecksums(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".md5", []byte(fmt.Sprintf("%x", md5.Sum(data))), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".sha1", []byte(fmt.Sprintf("%x", sha1.Sum(data))), 0644)
+}
+
 // AAR is the format for the binary distribution of an Android Library Project
 // and it is a ZIP archive with extension .aar.
 // http://tools.android.com/tech-docs/new-build-system/aar-format
@@ -224,7 +650,7 @@ func buildSrcJar(androidDir string) error {
 //	aidl (optional, not relevant)
 //
 // javac and jar commands are needed to build classes.jar.
-func buildAAR(androidDir string, pkgs []*build.Package, androidArchs []string) (err error) {
+func buildAAR(androidDir string, pkgs []*build.Package, androidArchs []string, nativeMeta bind.NativeMeta, excludeAssets map[string]bool) (err error) {
 	var out io.Writer = ioutil.Discard
 	if buildO == "" {
 		buildO = pkgs[0].Name + ".aar"
@@ -252,19 +678,37 @@ func buildAAR(androidDir string, pkgs []*build.Package, androidArchs []string) (
 		}
 		return aarw.Create(name)
 	}
+	manifestData, err := buildManifest(pkgs)
+	if err != nil {
+		return err
+	}
+
+	// aapt2 link (below) needs the manifest as a file on disk, not just as a zip entry.
+	manifestPath := filepath.Join(androidDir, "AndroidManifest.xml")
+	if !buildN {
+		if err := ioutil.WriteFile(manifestPath, manifestData, 0644); err != nil {
+			return err
+		}
+	}
 	w, err := aarwcreate("AndroidManifest.xml")
 	if err != nil {
 		return err
 	}
-	const manifestFmt = `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package=%q>
-<uses-sdk android:minSdkVersion="%d"/></manifest>`
-	fmt.Fprintf(w, manifestFmt, "go."+pkgs[0].Name+".gojni", minAndroidAPI)
+	if _, err := w.Write(manifestData); err != nil {
+		return err
+	}
 
+	proguardData, err := buildProguard(androidDir, pkgs)
+	if err != nil {
+		return err
+	}
 	w, err = aarwcreate("proguard.txt")
 	if err != nil {
 		return err
 	}
-	fmt.Fprintln(w, `-keep class go.** { *; }`)
+	if _, err := w.Write(proguardData); err != nil {
+		return err
+	}
 
 	w, err = aarwcreate("classes.jar")
 	if err != nil {
@@ -300,6 +744,9 @@ func buildAAR(androidDir string, pkgs []*build.Package, androidArchs []string) (
 					}
 					defer f.Close()
 					name := "assets/" + path[len(assetsDir)+1:]
+					if excludeAssets[path[len(assetsDir)+1:]] {
+						return nil
+					}
 					if orig, exists := files[name]; exists {
 						return fmt.Errorf("package %s asset name conflict: %s already added from package %s",
 							pkg.ImportPath, name, orig)
@@ -345,20 +792,573 @@ func buildAAR(androidDir string, pkgs []*build.Package, androidArchs []string) (
 		}
 	}
 
-	// TODO(hyangah): do we need to use aapt to create R.txt?
-	w, err = aarwcreate("R.txt")
+	if err := buildPrefab(androidDir, pkgs, androidArchs, nativeMeta, aarwcreate); err != nil {
+		return err
+	}
+
+	w, err = aarwcreate("aar-metadata.properties")
 	if err != nil {
 		return err
 	}
+	fmt.Fprintln(w, "aarFormatVersion=1.0")
+	if len(nativeMeta.Libs) > 0 {
+		// Only declared when buildPrefab actually wrote a prefab/prefab.json;
+		// AGP's Prefab integration expects the two to agree.
+		fmt.Fprintf(w, "prefabPackageVersion=%s\n", prefabPackageVersion())
+	}
 
-	w, err = aarwcreate("res/")
+	rTxt, err := buildResources(androidDir, pkgs, aarwcreate)
+	if err != nil {
+		return err
+	}
+	w, err = aarwcreate("R.txt")
 	if err != nil {
 		return err
 	}
+	if _, err := w.Write(rTxt); err != nil {
+		return err
+	}
 
 	return aarw.Close()
 }
 
+const androidNS = "http://schemas.android.com/apk/res/android"
+
+// manifestFragment is the subset of AndroidManifest.xml that buildManifest merges in
+// from a bound package's own AndroidManifest.xml or the -manifest flag.
+type manifestFragment struct {
+	XMLName        xml.Name       `xml:"manifest"`
+	Attr           []xml.Attr     `xml:",any,attr"`
+	UsesSDK        *manifestNode  `xml:"uses-sdk"`
+	UsesPermission []manifestNode `xml:"uses-permission"`
+	UsesFeature    []manifestNode `xml:"uses-feature"`
+	Application    struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"application"`
+}
+
+// nsPrefixes returns the xmlns:prefix declarations on the fragment's root <manifest>
+// element, keyed by namespace URI, so render can reproduce attributes like
+// tools:node="replace" under their original prefix instead of the resolved URI.
+func (f manifestFragment) nsPrefixes() map[string]string {
+	prefixes := map[string]string{}
+	for _, a := range f.Attr {
+		if a.Name.Space == "xmlns" {
+			prefixes[a.Value] = a.Name.Local
+		}
+	}
+	return prefixes
+}
+
+// manifestNode captures one manifest element generically, so it can be re-serialized
+// into the generated manifest without a model of the full Android manifest schema.
+type manifestNode struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+}
+
+func (n manifestNode) attrInt(local string) (int, bool) {
+	for _, a := range n.Attr {
+		if a.Name.Local == local {
+			v, err := strconv.Atoi(a.Value)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+// render re-serializes n, using an "android:" prefix for attributes in the Android
+// namespace and the fragment's own declared prefix (from nsPrefixes) for any other
+// namespace, e.g. the common tools:node="replace"/"remove" merge-conflict attributes.
+// An attribute in a namespace nsPrefixes doesn't know about falls back to its raw URI
+// rather than being silently dropped.
+func (n manifestNode) render(nsPrefixes map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s", n.XMLName.Local)
+	for _, a := range n.Attr {
+		name := a.Name.Local
+		switch {
+		case a.Name.Space == androidNS:
+			name = "android:" + name
+		case a.Name.Space != "":
+			if prefix, ok := nsPrefixes[a.Name.Space]; ok {
+				name = prefix + ":" + name
+			} else {
+				name = a.Name.Space + ":" + name
+			}
+		}
+		fmt.Fprintf(&b, ` %s=%q`, name, a.Value)
+	}
+	b.WriteString("/>")
+	return b.String()
+}
+
+// buildManifest generates the AAR's AndroidManifest.xml, merging in any
+// AndroidManifest.xml fragment found alongside a bound package's assets/ directory and
+// the fragment named by -manifest. uses-permission elements are de-duplicated by
+// android:name, and the effective minSdkVersion is the maximum of minAndroidAPI, -minsdk,
+// and every fragment's uses-sdk minSdkVersion.
+func buildManifest(pkgs []*build.Package) ([]byte, error) {
+	var fragments []manifestFragment
+	for _, pkg := range pkgs {
+		frag, err := loadManifestFragment(filepath.Join(pkg.Dir, "AndroidManifest.xml"))
+		if err != nil {
+			return nil, err
+		}
+		if frag != nil {
+			fragments = append(fragments, *frag)
+		}
+	}
+	if bindManifest != "" {
+		frag, err := loadManifestFragment(bindManifest)
+		if err != nil {
+			return nil, err
+		}
+		if frag == nil {
+			return nil, fmt.Errorf("-manifest %s: no such file", bindManifest)
+		}
+		fragments = append(fragments, *frag)
+	}
+
+	minSDK := minAndroidAPI
+	if bindMinSDK > 0 {
+		minSDK = bindMinSDK
+	}
+	targetSDK := bindTargetSDK
+	permNames := map[string]bool{}
+	var perms, features []string
+	var application strings.Builder
+	for _, frag := range fragments {
+		prefixes := frag.nsPrefixes()
+		if frag.UsesSDK != nil {
+			if v, ok := frag.UsesSDK.attrInt("minSdkVersion"); ok && v > minSDK {
+				minSDK = v
+			}
+			if v, ok := frag.UsesSDK.attrInt("targetSdkVersion"); ok && v > targetSDK {
+				targetSDK = v
+			}
+		}
+		for _, perm := range frag.UsesPermission {
+			name := ""
+			for _, a := range perm.Attr {
+				if a.Name.Space == androidNS && a.Name.Local == "name" {
+					name = a.Value
+				}
+			}
+			if name != "" && permNames[name] {
+				continue
+			}
+			permNames[name] = true
+			perms = append(perms, perm.render(prefixes))
+		}
+		for _, feat := range frag.UsesFeature {
+			features = append(features, feat.render(prefixes))
+		}
+		application.WriteString(frag.Application.Inner)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package=%q>`,
+		"go."+pkgs[0].Name+".gojni")
+	if targetSDK > 0 {
+		fmt.Fprintf(&b, `<uses-sdk android:minSdkVersion="%d" android:targetSdkVersion="%d"/>`, minSDK, targetSDK)
+	} else {
+		fmt.Fprintf(&b, `<uses-sdk android:minSdkVersion="%d"/>`, minSDK)
+	}
+	for _, p := range perms {
+		b.WriteString(p)
+	}
+	for _, f := range features {
+		b.WriteString(f)
+	}
+	if application.Len() > 0 {
+		fmt.Fprintf(&b, "<application>%s</application>", application.String())
+	}
+	b.WriteString("</manifest>")
+	return []byte(b.String()), nil
+}
+
+// loadManifestFragment parses path as an AndroidManifest.xml fragment. It returns a nil
+// fragment and nil error if path does not exist.
+func loadManifestFragment(path string) (*manifestFragment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var frag manifestFragment
+	if err := xml.Unmarshal(data, &frag); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &frag, nil
+}
+
+// stripSO strips unneeded symbols from the .so at path with llvm-strip, unless -nostrip
+// was given.
+func stripSO(path string) error {
+	if bindNoStrip {
+		return nil
+	}
+	strip, err := llvmStripPath()
+	if err != nil {
+		return err
+	}
+	return runCmd(exec.Command(strip, "--strip-unneeded", path))
+}
+
+// ndkHome returns the installed NDK's root directory, from ANDROID_NDK_HOME or else
+// ANDROID_HOME/ndk-bundle.
+func ndkHome() string {
+	if dir := os.Getenv("ANDROID_NDK_HOME"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("ANDROID_HOME"), "ndk-bundle")
+}
+
+// llvmStripPath locates llvm-strip under the installed NDK.
+func llvmStripPath() (string, error) {
+	dir := ndkHome()
+	matches, err := filepath.Glob(filepath.Join(dir, "toolchains/llvm/prebuilt/*/bin/llvm-strip"))
+	if err != nil || len(matches) == 0 {
+		return "", fmt.Errorf("llvm-strip not found under NDK at %s; install the NDK or pass -nostrip", dir)
+	}
+	return matches[0], nil
+}
+
+// prefabPackageVersion is the version recorded in prefab.json and aar-metadata.properties.
+func prefabPackageVersion() string {
+	if bindVersion != "" {
+		return bindVersion
+	}
+	return "1.0.0"
+}
+
+// prefabMinSDK is the Android API level recorded in each Prefab module's per-ABI abi.json.
+func prefabMinSDK() int {
+	if bindMinSDK > 0 {
+		return bindMinSDK
+	}
+	return minAndroidAPI
+}
+
+// ndkMajorVersion reads the installed NDK's Pkg.Revision from source.properties under
+// ANDROID_NDK_HOME (or ANDROID_HOME/ndk-bundle) and returns its major version number.
+func ndkMajorVersion() (int, error) {
+	dir := ndkHome()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "source.properties"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read NDK source.properties (required for Prefab abi.json): %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "Pkg.Revision" {
+			continue
+		}
+		rev := strings.TrimSpace(parts[1])
+		major := rev[:strings.Index(rev+".", ".")]
+		n, err := strconv.Atoi(major)
+		if err != nil {
+			return 0, fmt.Errorf("malformed NDK Pkg.Revision %q", rev)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("Pkg.Revision not found in %s", filepath.Join(dir, "source.properties"))
+}
+
+// buildPrefab writes a prefab/ tree into the AAR (schema_version 2) alongside the
+// existing jni/<abi>/ entries, so NDK/CMake consumers can link the bound package's
+// native libraries with find_package(). It is a no-op if nativeMeta.Libs is empty.
+func buildPrefab(androidDir string, pkgs []*build.Package, androidArchs []string, nativeMeta bind.NativeMeta, aarwcreate func(string) (io.Writer, error)) error {
+	if len(nativeMeta.Libs) == 0 {
+		return nil
+	}
+
+	ndkVer, err := ndkMajorVersion()
+	if err != nil {
+		return err
+	}
+	api := prefabMinSDK()
+
+	w, err := aarwcreate("prefab/prefab.json")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, `{"schema_version":2,"name":%q,"version":%q}`, pkgs[0].Name, prefabPackageVersion())
+
+	headers := map[string]string{}
+	for _, h := range bindHeaders {
+		headers[h.Lib] = h.Dir
+	}
+
+	for _, lib := range nativeMeta.Libs {
+		w, err := aarwcreate(fmt.Sprintf("prefab/modules/%s/module.json", lib))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, `{"export_libraries":[],"library_name":"lib%s"}`, lib)
+
+		if headerDir, ok := headers[lib]; ok {
+			err := filepath.Walk(headerDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				rel, err := filepath.Rel(headerDir, path)
+				if err != nil {
+					return err
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w, err := aarwcreate(fmt.Sprintf("prefab/modules/%s/include/%s", lib, filepath.ToSlash(rel)))
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(w, f)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, arch := range androidArchs {
+			toolchain := ndk.Toolchain(arch)
+			libPath := filepath.Join(androidDir, "src/main/jniLibs", toolchain.abi, fmt.Sprintf("lib%s.so", lib))
+
+			w, err := aarwcreate(fmt.Sprintf("prefab/modules/%s/libs/android.%s/abi.json", lib, toolchain.abi))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, `{"abi":%q,"api":%d,"ndk":%d,"stl":"none"}`, toolchain.abi, api, ndkVer)
+
+			w, err = aarwcreate(fmt.Sprintf("prefab/modules/%s/libs/android.%s/lib%s.so", lib, toolchain.abi, lib))
+			if err != nil {
+				return err
+			}
+			if !buildN {
+				r, err := os.Open(libPath)
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				if _, err := io.Copy(w, r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+const defaultProguardRule = "-keep class go.** { *; }"
+
+// buildProguard assembles the AAR's proguard.txt: the default keep rule, a keep rule
+// for every Java class GenJava generated under go/<pkg>/ so R8 doesn't strip
+// reflectively-accessed bound types, and the contents of each bound package's
+// proguard-rules.pro and consumer-rules.pro. Identical lines are only kept once.
+// With -noproguard, only the default keep rule is emitted.
+func buildProguard(androidDir string, pkgs []*build.Package) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString(defaultProguardRule + "\n")
+	if bindNoProguard {
+		return []byte(b.String()), nil
+	}
+	seen := map[string]bool{defaultProguardRule: true}
+
+	goJavaDir := filepath.Join(androidDir, "src/main/java/go")
+	javaRoot := filepath.Join(androidDir, "src/main/java")
+	err := filepath.Walk(goJavaDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".java" {
+			return nil
+		}
+		rel, err := filepath.Rel(javaRoot, path)
+		if err != nil {
+			return err
+		}
+		class := strings.Replace(strings.TrimSuffix(filepath.ToSlash(rel), ".java"), "/", ".", -1)
+		rule := fmt.Sprintf("-keep class %s { *; }", class)
+		if !seen[rule] {
+			seen[rule] = true
+			b.WriteString(rule + "\n")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pkg := range pkgs {
+		for _, name := range []string{"proguard-rules.pro", "consumer-rules.pro"} {
+			data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, name))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimRight(line, "\r")
+				if strings.TrimSpace(line) == "" || seen[line] {
+					continue
+				}
+				seen[line] = true
+				b.WriteString(line + "\n")
+			}
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// buildResources compiles the res/ directory of each bound package (if any) with aapt2,
+// links them into a static library against the SDK's android.jar, and copies the
+// resulting flat res/ tree into the AAR via aarwcreate. It returns the contents of
+// R.txt, or an empty R.txt if no bound package has a res/ directory.
+func buildResources(androidDir string, pkgs []*build.Package, aarwcreate func(string) (io.Writer, error)) ([]byte, error) {
+	compiledDir := filepath.Join(tmpdir, "compiled-res")
+	if err := mkdir(compiledDir); err != nil {
+		return nil, err
+	}
+
+	owner := map[string]string{} // compiled flat file name -> owning package, for collision reporting
+	var flatFiles []string
+	for _, pkg := range pkgs {
+		resDir := filepath.Join(pkg.Dir, "res")
+		fi, err := os.Stat(resDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		aapt2, err := aapt2Path()
+		if err != nil {
+			return nil, err
+		}
+		out := filepath.Join(compiledDir, pkg.Name)
+		if err := mkdir(out); err != nil {
+			return nil, err
+		}
+		if err := runCmd(exec.Command(aapt2, "compile", "--dir", resDir, "-o", out)); err != nil {
+			return nil, fmt.Errorf("aapt2 compile failed for package %s: %v", pkg.ImportPath, err)
+		}
+		flats, err := ioutil.ReadDir(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, flat := range flats {
+			name := flat.Name()
+			if orig, exists := owner[name]; exists {
+				return nil, fmt.Errorf("package %s resource name conflict: %s already added from package %s",
+					pkg.ImportPath, name, orig)
+			}
+			owner[name] = pkg.ImportPath
+			flatFiles = append(flatFiles, filepath.Join(out, name))
+		}
+	}
+
+	if len(flatFiles) == 0 {
+		// No bound package declares resources; keep the mandatory empty entries.
+		if _, err := aarwcreate("res/"); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	apiPath, err := androidAPIPath()
+	if err != nil {
+		return nil, err
+	}
+	aapt2, err := aapt2Path()
+	if err != nil {
+		return nil, err
+	}
+
+	linkedAPK := filepath.Join(tmpdir, "linked-res.apk")
+	rTxtPath := filepath.Join(tmpdir, "R.txt")
+	args := append([]string{
+		"link", "--static-lib",
+		"-I", filepath.Join(apiPath, "android.jar"),
+		"--manifest", filepath.Join(androidDir, "AndroidManifest.xml"),
+		"--output-text-symbols", rTxtPath,
+		"-o", linkedAPK,
+	}, flatFiles...)
+	if err := runCmd(exec.Command(aapt2, args...)); err != nil {
+		return nil, fmt.Errorf("aapt2 link failed: %v", err)
+	}
+
+	if buildN {
+		return nil, nil
+	}
+
+	r, err := zip.OpenReader(linkedAPK)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "res/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		w, err := aarwcreate(f.Name)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ioutil.ReadFile(rTxtPath)
+}
+
+// aapt2Path locates aapt2 under the newest installed build-tools revision in ANDROID_HOME.
+func aapt2Path() (string, error) {
+	sdk := os.Getenv("ANDROID_HOME")
+	buildTools := filepath.Join(sdk, "build-tools")
+	fis, err := ioutil.ReadDir(buildTools)
+	if err != nil {
+		return "", fmt.Errorf("failed to find Android build-tools (required to compile resources with aapt2): %v", err)
+	}
+	var latest string
+	for _, fi := range fis {
+		if fi.IsDir() && fi.Name() > latest {
+			latest = fi.Name()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no Android build-tools found in %s; install build-tools to bind packages with res/ directories", buildTools)
+	}
+	aapt2 := filepath.Join(buildTools, latest, "aapt2")
+	if _, err := os.Stat(aapt2); err != nil {
+		return "", fmt.Errorf("aapt2 not found in build-tools %s: %v", latest, err)
+	}
+	return aapt2, nil
+}
+
 const (
 	javacTargetVer = "1.7"
 	minAndroidAPI  = 15
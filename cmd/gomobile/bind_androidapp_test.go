@@ -0,0 +1,245 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGomobileConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]abiOverride
+		wantErr string
+	}{
+		{
+			name: "exclude and ldflags",
+			data: "abis:\n" +
+				"  arm64-v8a:\n" +
+				"    exclude: true\n" +
+				"  armeabi-v7a:\n" +
+				"    ldflags: -s -w\n",
+			want: map[string]abiOverride{
+				"arm64-v8a":   {Exclude: true},
+				"armeabi-v7a": {LDFlags: "-s -w"},
+			},
+		},
+		{
+			name: "excludeAssets list",
+			data: "abis:\n" +
+				"  x86:\n" +
+				"    excludeAssets:\n" +
+				"      - debug/symbols.txt\n" +
+				"      - debug/trace.bin\n",
+			want: map[string]abiOverride{
+				"x86": {ExcludeAssets: []string{"debug/symbols.txt", "debug/trace.bin"}},
+			},
+		},
+		{
+			name: "explicit exclude false",
+			data: "abis:\n" +
+				"  x86_64:\n" +
+				"    exclude: false\n",
+			want: map[string]abiOverride{
+				"x86_64": {Exclude: false},
+			},
+		},
+		{
+			name:    "unrecognized exclude literal",
+			data:    "abis:\n  arm64-v8a:\n    exclude: yes\n",
+			wantErr: `line 3: exclude must be "true" or "false", got "yes"`,
+		},
+		{
+			name:    "unrecognized exclude literal True",
+			data:    "abis:\n  arm64-v8a:\n    exclude: True\n",
+			wantErr: `line 3: exclude must be "true" or "false", got "True"`,
+		},
+		{
+			name:    "unknown key",
+			data:    "abis:\n  arm64-v8a:\n    optimize: true\n",
+			wantErr: `line 3: unknown key "optimize"`,
+		},
+		{
+			name:    "missing top-level abis key",
+			data:    "abi:\n  arm64-v8a:\n    exclude: true\n",
+			wantErr: `line 1: expected top-level "abis:" key, got "abi:"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := parseGomobileConfig(tc.data)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseGomobileConfig(%q) error = %v, want containing %q", tc.data, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGomobileConfig(%q): %v", tc.data, err)
+			}
+			if len(cfg.ABIs) != len(tc.want) {
+				t.Fatalf("parseGomobileConfig(%q) = %+v, want %+v", tc.data, cfg.ABIs, tc.want)
+			}
+			for abi, want := range tc.want {
+				got, ok := cfg.ABIs[abi]
+				if !ok {
+					t.Fatalf("parseGomobileConfig(%q): missing ABI %q", tc.data, abi)
+				}
+				if got.Exclude != want.Exclude || got.LDFlags != want.LDFlags || !equalStrings(got.ExcludeAssets, want.ExcludeAssets) {
+					t.Fatalf("parseGomobileConfig(%q): ABI %q = %+v, want %+v", tc.data, abi, got, want)
+				}
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFilterAndroidArchsUnknownABI(t *testing.T) {
+	cfg, err := parseGomobileConfig("abis:\n  armeabi-v7:\n    exclude: true\n")
+	if err != nil {
+		t.Fatalf("parseGomobileConfig: %v", err)
+	}
+	if _, err := filterAndroidArchs([]string{"arm", "arm64"}, cfg); err == nil {
+		t.Fatal("filterAndroidArchs with typo'd ABI key: got nil error, want one naming the unknown ABI")
+	} else if !strings.Contains(err.Error(), "armeabi-v7") {
+		t.Fatalf("filterAndroidArchs error = %v, want it to mention %q", err, "armeabi-v7")
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	defer func(minSDK, targetSDK int, manifest string) {
+		bindMinSDK, bindTargetSDK, bindManifest = minSDK, targetSDK, manifest
+	}(bindMinSDK, bindTargetSDK, bindManifest)
+
+	dir1 := writeTempManifest(t, `<manifest xmlns:android="http://schemas.android.com/apk/res/android" xmlns:tools="http://schemas.android.com/tools">
+		<uses-sdk android:minSdkVersion="19"/>
+		<uses-permission android:name="android.permission.INTERNET"/>
+		<uses-permission android:name="android.permission.CAMERA" tools:node="remove"/>
+		<application android:label="one"/>
+	</manifest>`)
+	dir2 := writeTempManifest(t, `<manifest xmlns:android="http://schemas.android.com/apk/res/android">
+		<uses-sdk android:minSdkVersion="15" android:targetSdkVersion="30"/>
+		<uses-permission android:name="android.permission.INTERNET"/>
+		<uses-feature android:name="android.hardware.camera" android:required="false"/>
+	</manifest>`)
+
+	bindMinSDK, bindTargetSDK, bindManifest = 0, 0, ""
+	pkgs := []*build.Package{{Dir: dir1, Name: "pkgone"}, {Dir: dir2, Name: "pkgtwo"}}
+
+	out, err := buildManifest(pkgs)
+	if err != nil {
+		t.Fatalf("buildManifest: %v", err)
+	}
+	manifest := string(out)
+
+	if strings.Count(manifest, `android:name="android.permission.INTERNET"`) != 1 {
+		t.Errorf("buildManifest did not de-duplicate the repeated INTERNET permission:\n%s", manifest)
+	}
+	if !strings.Contains(manifest, `tools:node="remove"`) {
+		t.Errorf("buildManifest dropped the non-Android tools: namespace prefix:\n%s", manifest)
+	}
+	if !strings.Contains(manifest, `android:minSdkVersion="19"`) {
+		t.Errorf("buildManifest did not take the max minSdkVersion across fragments (want 19):\n%s", manifest)
+	}
+	if !strings.Contains(manifest, `android:targetSdkVersion="30"`) {
+		t.Errorf("buildManifest did not carry through targetSdkVersion from the fragment:\n%s", manifest)
+	}
+	if !strings.Contains(manifest, `android.hardware.camera`) {
+		t.Errorf("buildManifest dropped a uses-feature element:\n%s", manifest)
+	}
+}
+
+func writeTempManifest(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gomobile-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "AndroidManifest.xml"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// tempDir creates a temporary directory removed when the test completes.
+func tempDir(t *testing.T, prefix string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestBuildProguardDedup(t *testing.T) {
+	defer func(noProguard bool) { bindNoProguard = noProguard }(bindNoProguard)
+	bindNoProguard = false
+
+	androidDir := tempDir(t, "gomobile-proguard")
+
+	goJavaDir := filepath.Join(androidDir, "src/main/java/go/pkgone")
+	if err := os.MkdirAll(goJavaDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(goJavaDir, "Pkgone.java"), []byte("package go.pkgone;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgDir := tempDir(t, "gomobile-pkg")
+	rules := "-keep class go.pkgone.Pkgone { *; }\n-dontwarn go.pkgone.**\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "proguard-rules.pro"), []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := buildProguard(androidDir, []*build.Package{{Dir: pkgDir, Name: "pkgone"}})
+	if err != nil {
+		t.Fatalf("buildProguard: %v", err)
+	}
+	got := string(out)
+
+	if strings.Count(got, "-keep class go.pkgone.Pkgone { *; }") != 1 {
+		t.Errorf("buildProguard did not de-duplicate the rule generated from the Java file and the one\n"+
+			"already present in proguard-rules.pro:\n%s", got)
+	}
+	if !strings.Contains(got, "-dontwarn go.pkgone.**") {
+		t.Errorf("buildProguard dropped a rule from proguard-rules.pro:\n%s", got)
+	}
+	if !strings.Contains(got, defaultProguardRule) {
+		t.Errorf("buildProguard dropped the default rule:\n%s", got)
+	}
+}
+
+func TestBuildProguardNoProguard(t *testing.T) {
+	defer func(noProguard bool) { bindNoProguard = noProguard }(bindNoProguard)
+	bindNoProguard = true
+
+	out, err := buildProguard(tempDir(t, "gomobile-proguard-none"), nil)
+	if err != nil {
+		t.Fatalf("buildProguard: %v", err)
+	}
+	if got := string(out); got != defaultProguardRule+"\n" {
+		t.Errorf("buildProguard with -noproguard: got %q, want only the default rule", got)
+	}
+}